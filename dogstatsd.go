@@ -0,0 +1,678 @@
+// Copyright 2013 Ooyala, Inc.
+
+/*
+Package dogstatsd provides a Go dogstatsd client. Dogstatsd extends the
+statsd protocol to support arbitrary tags on each metric, which are added
+as a suffix to the normal statsd format.
+
+Example Usage:
+
+	// Create the client
+	c, err := dogstatsd.New("127.0.0.1:8125")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Prefix every metric with the app name
+	c.Namespace = "flubber."
+	// Send the EC2 availability zone as a tag with every metric
+	c.Tags = append(c.Tags, "us-east-1a")
+	err = c.Gauge("request.duration", 1.2, nil, 1)
+
+dogstatsd is based on go-statsd-client.
+*/
+package dogstatsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// unixAddrPrefix is the scheme New recognizes for dialing a unix datagram
+// socket instead of UDP, e.g. "unix:///var/run/datadog/dsd.socket".
+const unixAddrPrefix = "unix://"
+
+// maxUDSRetries bounds the number of resend attempts when a unix
+// datagram socket reports a transient error such as EAGAIN or ENOBUFS.
+// Unlike UDP, which silently drops packets under backpressure, UDS surfaces
+// these to the writer, so a brief backoff-and-retry avoids dropping a metric
+// that would otherwise have gone through a moment later.
+const maxUDSRetries = 2
+
+// udsRetryDelay is the base backoff between UDS write retries; it doubles
+// with each attempt.
+const udsRetryDelay = 10 * time.Millisecond
+
+// defaultFlushInterval is the FlushInterval a buffered Client uses unless
+// the caller sets a different one before its first metric is sent.
+const defaultFlushInterval = 100 * time.Millisecond
+
+// Metric type markers used as aggregation keys; they match the suffix each
+// type's DogStatsD line ends with.
+const (
+	metricCount = 'c'
+	metricGauge = 'g'
+)
+
+// aggregatedMetric accumulates a Count sum, or the last Gauge value seen,
+// for a single (name, tags, rate) tuple within a flush window.
+type aggregatedMetric struct {
+	metricType byte
+	name       string
+	tags       []string
+	rate       float64
+	count      int64
+	value      string
+}
+
+// Transport is what a Client writes its formatted DogStatsD lines to. New
+// dials a udpTransport or udsTransport depending on the addr scheme;
+// NewWithTransport accepts any Transport, which is how a CapturingTransport
+// is wired in for tests that want to assert on emitted metrics without a
+// real socket.
+type Transport interface {
+	Write([]byte) error
+	Close() error
+}
+
+// A Client is a handle for sending messages to dogstatsd through its
+// Transport (UDP, a unix datagram socket, or any other).  It is safe to
+// use one Client from multiple goroutines simultaneously.
+type Client struct {
+	transport Transport
+	// Namespace to prepend to all statsd calls
+	Namespace string
+	// Tags are global tags to be added to every statsd call
+	Tags []string
+	// bufferLength is how many commands are buffered before a flush; zero
+	// means every command is written to the transport immediately.
+	bufferLength int
+	commands     []string
+	// FlushInterval is how often a buffered Client flushes in the
+	// background, as passed to NewBufferedWithInterval (defaultFlushInterval
+	// for NewBuffered). The background flusher reads it once, when it
+	// starts, so changing it after the Client is constructed has no effect;
+	// it has no effect on an unbuffered Client either.
+	FlushInterval time.Duration
+	// ClientSideAggregation, when true on a buffered Client, collapses
+	// repeated Count calls for the same (name, tags, rate) into a running
+	// sum and keeps only the last value seen for Gauge, emitting one line
+	// per metric per flush instead of one line per call. This can
+	// dramatically cut UDP packet volume for hot counters in tight loops.
+	// Set is excluded: collapsing to the last value would silently drop
+	// distinct members, so Set always sends one line per call.
+	// The aggregation window is the same as the flush window: FlushInterval
+	// for a background-flushed Client, or however often flush() is called.
+	ClientSideAggregation bool
+	// mu guards commands, aggregated and writes to transport, since
+	// Count/Gauge/Histogram/Set and the background flusher can all run
+	// concurrently.
+	mu         sync.Mutex
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	aggregated map[string]*aggregatedMetric
+	// closeOnce guards stopping the background flusher so a second Close
+	// call is a no-op instead of panicking on an already-closed stop.
+	closeOnce sync.Once
+}
+
+// New returns a pointer to a new Client and an error.
+// addr must have the format "hostname:port", or "unix://path/to/socket" to
+// send over a unix datagram socket instead of UDP.
+func New(addr string) (*Client, error) {
+	transport, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithTransport(transport), nil
+}
+
+// NewWithTransport returns a Client that writes through transport directly,
+// bypassing New's address parsing. This is how a *CapturingTransport is
+// wired in for tests that want to assert on emitted metrics without a real
+// socket.
+func NewWithTransport(transport Transport) *Client {
+	return &Client{transport: transport}
+}
+
+// dial opens a Transport appropriate to addr's scheme: a unix datagram
+// socket for "unix://" addresses, UDP otherwise.
+func dial(addr string) (Transport, error) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return newUDSTransport(strings.TrimPrefix(addr, unixAddrPrefix))
+	}
+	return newUDPTransport(addr)
+}
+
+// udpTransport sends over a UDP socket.
+type udpTransport struct {
+	conn net.Conn
+}
+
+func newUDPTransport(addr string) (*udpTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+func (t *udpTransport) Write(data []byte) error {
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// udsTransport sends over a unix datagram socket. Unlike UDP, which
+// silently drops packets under backpressure, UDS surfaces a transient
+// EAGAIN or ENOBUFS to the writer when the kernel buffer is momentarily
+// full, so writes are retried a bounded number of times with a short
+// backoff before giving up.
+type udsTransport struct {
+	conn net.Conn
+}
+
+func newUDSTransport(path string) (*udsTransport, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &udsTransport{conn: conn}, nil
+}
+
+func (t *udsTransport) Write(data []byte) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		_, err = t.conn.Write(data)
+		if err == nil || !isTransientUDSError(err) || attempt >= maxUDSRetries {
+			return err
+		}
+		time.Sleep(udsRetryDelay << uint(attempt))
+	}
+}
+
+func (t *udsTransport) Close() error {
+	return t.conn.Close()
+}
+
+// isTransientUDSError reports whether err is a backpressure error that is
+// worth retrying on a unix datagram socket.
+func isTransientUDSError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == syscall.EAGAIN || errno == syscall.ENOBUFS
+	}
+	return false
+}
+
+// CapturingTransport is a Transport that stores every payload written to it
+// in memory instead of sending it over the network, so downstream users can
+// write unit tests against their metric emissions without network I/O.
+type CapturingTransport struct {
+	mu       sync.Mutex
+	Payloads [][]byte
+}
+
+// Write records a copy of data.
+func (t *CapturingTransport) Write(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	payload := make([]byte, len(data))
+	copy(payload, data)
+	t.Payloads = append(t.Payloads, payload)
+	return nil
+}
+
+// Close is a no-op; there is nothing to release.
+func (t *CapturingTransport) Close() error {
+	return nil
+}
+
+// NewBuffered returns a Client that buffers its output and sends it in
+// chunks. Buflen is the length of the buffer in number of commands. The
+// background flusher uses defaultFlushInterval; use
+// NewBufferedWithInterval to choose a different one.
+func NewBuffered(addr string, buflen int) (*Client, error) {
+	return NewBufferedWithInterval(addr, buflen, defaultFlushInterval)
+}
+
+// NewBufferedWithInterval is like NewBuffered, but lets the caller choose
+// how often the background flusher sends a partially filled buffer. A
+// flushInterval <= 0 uses defaultFlushInterval.
+func NewBufferedWithInterval(addr string, buflen int, flushInterval time.Duration) (*Client, error) {
+	client, err := New(addr)
+	if err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+	client.bufferLength = buflen
+	client.commands = make([]string, 0, buflen)
+	client.FlushInterval = flushInterval
+	client.watch()
+	return client, nil
+}
+
+// watch starts the background goroutine that flushes a buffered Client on
+// FlushInterval, so low-volume callers that never fill the buffer still get
+// their metrics sent in a timely fashion. Close stops it.
+func (c *Client) watch() {
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.flush()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// format a message from its name, value, tags and rate. Also adds global
+// namespace and tags.
+func (c *Client) format(name, value string, tags []string, rate float64) string {
+	var buf bytes.Buffer
+	if c.Namespace != "" {
+		buf.WriteString(c.Namespace)
+	}
+	buf.WriteString(name)
+	buf.WriteString(":")
+	buf.WriteString(value)
+
+	if rate < 1 {
+		buf.WriteString(`|@`)
+		buf.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+
+	allTags := make([]string, 0, len(c.Tags)+len(tags))
+	allTags = append(allTags, c.Tags...)
+	tags = append(allTags, tags...)
+	if len(tags) > 0 {
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(tags, ","))
+	}
+
+	return buf.String()
+}
+
+// send handles sampling and fully formats the statsd message before handing
+// it to sendRaw.
+func (c *Client) send(name, value string, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	if rate < 1 && rand.Float64() > rate {
+		return nil
+	}
+	return c.sendRaw(c.format(name, value, tags, rate))
+}
+
+// sendRaw enqueues an already-formatted DogStatsD line, either appending it
+// to the buffer or writing it straight to the socket, depending on whether
+// the client is buffered.
+func (c *Client) sendRaw(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bufferLength > 0 {
+		c.appendCommand(line)
+		return nil
+	}
+	return c.sendMsg(line)
+}
+
+// appendCommand adds a fully formatted statsd command to the buffer,
+// flushing it first if it is already full. The caller must hold c.mu.
+func (c *Client) appendCommand(cmd string) {
+	if len(c.commands) == cap(c.commands) {
+		c.flushLocked()
+	}
+	c.commands = append(c.commands, cmd)
+}
+
+// flush sends the commands currently buffered, joined by newlines, and
+// resets the buffer.
+func (c *Client) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+// flushLocked is flush's implementation; the caller must hold c.mu.
+func (c *Client) flushLocked() error {
+	for _, m := range c.aggregated {
+		c.commands = append(c.commands, c.formatAggregated(m))
+	}
+	if len(c.aggregated) > 0 {
+		c.aggregated = make(map[string]*aggregatedMetric)
+	}
+
+	if len(c.commands) == 0 {
+		return nil
+	}
+	data := strings.Join(c.commands, "\n")
+	c.commands = c.commands[:0]
+	return c.sendMsg(data)
+}
+
+// formatAggregated renders the single line an aggregated counter or gauge
+// collapses down to.
+func (c *Client) formatAggregated(m *aggregatedMetric) string {
+	if m.metricType == metricCount {
+		return c.format(m.name, fmt.Sprintf("%d|c", m.count), m.tags, m.rate)
+	}
+	return c.format(m.name, fmt.Sprintf("%s|%c", m.value, m.metricType), m.tags, m.rate)
+}
+
+// aggregationKey returns the canonical identity ClientSideAggregation groups
+// samples under: metric type, name, tags and rate must all match to collapse.
+func aggregationKey(metricType byte, name string, tags []string, rate float64) string {
+	return fmt.Sprintf("%c|%s|%s|%v", metricType, name, strings.Join(tags, ","), rate)
+}
+
+// aggregateCount folds value into the running sum kept for (name, tags,
+// rate), to be emitted as a single Count line on the next flush.
+func (c *Client) aggregateCount(name string, value int64, tags []string, rate float64) error {
+	if rate < 1 && rand.Float64() > rate {
+		return nil
+	}
+	key := aggregationKey(metricCount, name, tags, rate)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aggregated == nil {
+		c.aggregated = make(map[string]*aggregatedMetric)
+	}
+	m, ok := c.aggregated[key]
+	if !ok {
+		m = &aggregatedMetric{metricType: metricCount, name: name, tags: tags, rate: rate}
+		c.aggregated[key] = m
+	}
+	m.count += value
+	return nil
+}
+
+// aggregateLastValue records value as the most recent Gauge sample for
+// (name, tags, rate), discarding whatever value was recorded before it.
+func (c *Client) aggregateLastValue(metricType byte, name, value string, tags []string, rate float64) error {
+	if rate < 1 && rand.Float64() > rate {
+		return nil
+	}
+	key := aggregationKey(metricType, name, tags, rate)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aggregated == nil {
+		c.aggregated = make(map[string]*aggregatedMetric)
+	}
+	m, ok := c.aggregated[key]
+	if !ok {
+		m = &aggregatedMetric{metricType: metricType, name: name, tags: tags, rate: rate}
+		c.aggregated[key] = m
+	}
+	m.value = value
+	return nil
+}
+
+// sendMsg writes data to the underlying transport.
+func (c *Client) sendMsg(data string) error {
+	return c.transport.Write([]byte(data))
+}
+
+// Gauge measures the value of a metric at a particular time.
+func (c *Client) Gauge(name string, value float64, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	if c.bufferLength > 0 && c.ClientSideAggregation {
+		return c.aggregateLastValue(metricGauge, name, fmt.Sprintf("%f", value), tags, rate)
+	}
+	stat := fmt.Sprintf("%f|g", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// Count tracks how many times something happened per second.
+func (c *Client) Count(name string, value int64, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	if c.bufferLength > 0 && c.ClientSideAggregation {
+		return c.aggregateCount(name, value, tags, rate)
+	}
+	stat := fmt.Sprintf("%d|c", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// Histogram tracks the statistical distribution of a set of values.
+func (c *Client) Histogram(name string, value float64, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	stat := fmt.Sprintf("%f|h", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// Set counts the number of unique elements in a group. It is not affected
+// by ClientSideAggregation: collapsing Set samples to the last value seen
+// would silently drop distinct members, so every call is sent on its own.
+func (c *Client) Set(name string, value string, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	stat := fmt.Sprintf("%s|s", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// Distribution tracks the statistical distribution of a set of values
+// across your entire infrastructure, computing global percentiles
+// server-side rather than per-host like Histogram.
+func (c *Client) Distribution(name string, value float64, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	stat := fmt.Sprintf("%f|d", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// TimeInMilliseconds sends timing information, in milliseconds.
+func (c *Client) TimeInMilliseconds(name string, value float64, tags []string, rate float64) error {
+	if c == nil {
+		return nil
+	}
+	stat := fmt.Sprintf("%f|ms", value)
+	return c.send(name, stat, tags, rate)
+}
+
+// Timing sends timing information as a time.Duration, converting it to
+// milliseconds for the wire format.
+func (c *Client) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return c.TimeInMilliseconds(name, float64(value)/float64(time.Millisecond), tags, rate)
+}
+
+// EventAlertType is the alert_type field of a DogStatsD event.
+type EventAlertType string
+
+// The alert types recognized by the Datadog event API.
+const (
+	Info    EventAlertType = "info"
+	Error   EventAlertType = "error"
+	Warning EventAlertType = "warning"
+	Success EventAlertType = "success"
+)
+
+// EventPriority is the priority field of a DogStatsD event.
+type EventPriority string
+
+// The priorities recognized by the Datadog event API.
+const (
+	Normal EventPriority = "normal"
+	Low    EventPriority = "low"
+)
+
+// EventOptions holds the optional fields of a DogStatsD event. A nil
+// *EventOptions is equivalent to an empty one.
+type EventOptions struct {
+	// Timestamp defaults to the current time when left zero.
+	Timestamp time.Time
+	Hostname  string
+	// AggregationKey groups this event with others sharing the same key.
+	AggregationKey string
+	Priority       EventPriority
+	AlertType      EventAlertType
+	// Tags are added to Client.Tags for this event only.
+	Tags []string
+}
+
+// Event sends a custom event, as described in the Datadog event API:
+// http://docs.datadoghq.com/guides/dogstatsd/#events
+func (c *Client) Event(title, text string, opts *EventOptions) error {
+	if c == nil {
+		return nil
+	}
+	if opts == nil {
+		opts = &EventOptions{}
+	}
+
+	title = escapeEventText(title)
+	text = escapeEventText(text)
+	if c.Namespace != "" {
+		title = c.Namespace + title
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "_e{%d,%d}:%s|%s", len(title), len(text), title, text)
+
+	if !opts.Timestamp.IsZero() {
+		fmt.Fprintf(&buf, "|d:%d", opts.Timestamp.Unix())
+	}
+	if opts.Hostname != "" {
+		fmt.Fprintf(&buf, "|h:%s", opts.Hostname)
+	}
+	if opts.Priority != "" {
+		fmt.Fprintf(&buf, "|p:%s", opts.Priority)
+	}
+	if opts.AlertType != "" {
+		fmt.Fprintf(&buf, "|t:%s", opts.AlertType)
+	}
+
+	tags := make([]string, 0, len(c.Tags)+len(opts.Tags))
+	tags = append(tags, c.Tags...)
+	tags = append(tags, opts.Tags...)
+	if len(tags) > 0 {
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(tags, ","))
+	}
+	if opts.AggregationKey != "" {
+		fmt.Fprintf(&buf, "|k:%s", opts.AggregationKey)
+	}
+
+	return c.sendRaw(buf.String())
+}
+
+// escapeEventText escapes newlines, which would otherwise be interpreted by
+// the agent as the end of the event line.
+func escapeEventText(s string) string {
+	return strings.Replace(s, "\n", "\\n", -1)
+}
+
+// ServiceCheckStatus is the status field of a DogStatsD service check.
+type ServiceCheckStatus int
+
+// The statuses recognized by the Datadog service check API.
+const (
+	Ok ServiceCheckStatus = iota
+	Warn
+	Critical
+	Unknown
+)
+
+// ServiceCheckOptions holds the optional fields of a DogStatsD service
+// check. A nil *ServiceCheckOptions is equivalent to an empty one.
+type ServiceCheckOptions struct {
+	// Timestamp defaults to the current time when left zero.
+	Timestamp time.Time
+	Hostname  string
+	// Tags are added to Client.Tags for this service check only.
+	Tags    []string
+	Message string
+}
+
+// ServiceCheck sends the status of a service check, as described in the
+// Datadog service check API: http://docs.datadoghq.com/guides/dogstatsd/#service-checks
+func (c *Client) ServiceCheck(name string, status ServiceCheckStatus, opts *ServiceCheckOptions) error {
+	if c == nil {
+		return nil
+	}
+	if opts == nil {
+		opts = &ServiceCheckOptions{}
+	}
+	if c.Namespace != "" {
+		name = c.Namespace + name
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "_sc|%s|%d", name, status)
+
+	if !opts.Timestamp.IsZero() {
+		fmt.Fprintf(&buf, "|d:%d", opts.Timestamp.Unix())
+	}
+	if opts.Hostname != "" {
+		fmt.Fprintf(&buf, "|h:%s", opts.Hostname)
+	}
+
+	tags := make([]string, 0, len(c.Tags)+len(opts.Tags))
+	tags = append(tags, c.Tags...)
+	tags = append(tags, opts.Tags...)
+	if len(tags) > 0 {
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(tags, ","))
+	}
+	if opts.Message != "" {
+		fmt.Fprintf(&buf, "|m:%s", escapeEventText(opts.Message))
+	}
+
+	return c.sendRaw(buf.String())
+}
+
+// Close stops the background flusher, if one is running, flushes any
+// buffered commands, and closes the underlying transport.
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	if c.stop != nil {
+		c.closeOnce.Do(func() {
+			close(c.stop)
+			c.wg.Wait()
+		})
+	}
+	if c.bufferLength > 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	return c.transport.Close()
+}
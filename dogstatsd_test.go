@@ -5,9 +5,13 @@ package dogstatsd
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var dogstatsdTests = []struct {
@@ -31,6 +35,9 @@ var dogstatsdTests = []struct {
 	{"", nil, "Set", "test.set", "uuid", []string{"tagA"}, 1.0, "test.set:uuid|s|#tagA"},
 	{"flubber.", nil, "Set", "test.set", "uuid", []string{"tagA"}, 1.0, "flubber.test.set:uuid|s|#tagA"},
 	{"", []string{"tagC"}, "Set", "test.set", "uuid", []string{"tagA"}, 1.0, "test.set:uuid|s|#tagC,tagA"},
+	{"", nil, "Distribution", "test.distribution", 2.3, []string{"tagA"}, 1.0, "test.distribution:2.300000|d|#tagA"},
+	{"", nil, "TimeInMilliseconds", "test.timing", 2.3, []string{"tagA"}, 1.0, "test.timing:2.300000|ms|#tagA"},
+	{"", nil, "Timing", "test.timing", time.Duration(123456789), []string{"tagA"}, 1.0, "test.timing:123.456789|ms|#tagA"},
 }
 
 func assertNotPanics(t *testing.T, f func()) {
@@ -106,7 +113,7 @@ func TestBufferedClient(t *testing.T) {
 
 	bufferLength := 5
 	client := &Client{
-		conn:         conn,
+		transport:    &udpTransport{conn: conn},
 		commands:     make([]string, 0, bufferLength),
 		bufferLength: bufferLength,
 	}
@@ -157,6 +164,504 @@ func TestBufferedClient(t *testing.T) {
 
 }
 
+func TestUDSClient(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "dsd.socket")
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := New("unix://" + sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range dogstatsdTests {
+		client.Namespace = tt.GlobalNamespace
+		client.Tags = tt.GlobalTags
+		method := reflect.ValueOf(client).MethodByName(tt.Method)
+		e := method.Call([]reflect.Value{
+			reflect.ValueOf(tt.Metric),
+			reflect.ValueOf(tt.Value),
+			reflect.ValueOf(tt.Tags),
+			reflect.ValueOf(tt.Rate)})[0]
+		errInter := e.Interface()
+		if errInter != nil {
+			t.Fatal(errInter.(error))
+		}
+
+		bytes := make([]byte, 1024)
+		n, err := server.Read(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := bytes[:n]
+		if string(message) != tt.Expected {
+			t.Errorf("Expected: %s. Actual: %s", tt.Expected, string(message))
+		}
+	}
+}
+
+func TestBufferedUDSClient(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "dsd.socket")
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sockPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufferLength := 5
+	client := &Client{
+		transport:    &udsTransport{conn: conn},
+		commands:     make([]string, 0, bufferLength),
+		bufferLength: bufferLength,
+	}
+
+	client.Namespace = "foo."
+	client.Tags = []string{"dd:2"}
+
+	client.Count("cc", 1, nil, 1)
+	client.Gauge("gg", 10, nil, 1)
+	client.Histogram("hh", 1, nil, 1)
+	client.Set("ss", "ss", nil, 1)
+
+	if len(client.commands) != 4 {
+		t.Errorf("Expected client to have buffered 4 commands, but found %d\n", len(client.commands))
+	}
+
+	client.Set("ss", "xx", nil, 1)
+	err = client.flush()
+	if err != nil {
+		t.Errorf("Error sending: %s", err)
+	}
+
+	if len(client.commands) != 0 {
+		t.Errorf("Expecting send to flush commands, but found %d\n", len(client.commands))
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	result := string(buffer[:n])
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{
+		`foo.cc:1|c|#dd:2`,
+		`foo.gg:10.000000|g|#dd:2`,
+		`foo.hh:1.000000|h|#dd:2`,
+		`foo.ss:ss|s|#dd:2`,
+		`foo.ss:xx|s|#dd:2`,
+	}
+
+	for i, res := range strings.Split(result, "\n") {
+		if res != expected[i] {
+			t.Errorf("Got `%s`, expected `%s`", res, expected[i])
+		}
+	}
+}
+
+var eventTests = []struct {
+	Namespace string
+	Title     string
+	Text      string
+	Opts      *EventOptions
+	Expected  string
+}{
+	{"", "test title", "test text", nil, "_e{10,9}:test title|test text"},
+	{"", "test title", "test text", &EventOptions{Priority: Low}, "_e{10,9}:test title|test text|p:low"},
+	{"", "test title", "test text", &EventOptions{AlertType: Warning}, "_e{10,9}:test title|test text|t:warning"},
+	{"", "test title", "test text", &EventOptions{Hostname: "hostname"}, "_e{10,9}:test title|test text|h:hostname"},
+	{"", "test title", "test text", &EventOptions{Tags: []string{"tagA"}}, "_e{10,9}:test title|test text|#tagA"},
+	{"", "test title", "test text", &EventOptions{AggregationKey: "key"}, "_e{10,9}:test title|test text|k:key"},
+	{"flubber.", "test title", "test text", nil, "_e{18,9}:flubber.test title|test text"},
+}
+
+func TestEvent(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range eventTests {
+		client.Namespace = tt.Namespace
+		if err := client.Event(tt.Title, tt.Text, tt.Opts); err != nil {
+			t.Fatal(err)
+		}
+
+		bytes := make([]byte, 1024)
+		n, err := server.Read(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := bytes[:n]
+		if string(message) != tt.Expected {
+			t.Errorf("Expected: %s. Actual: %s", tt.Expected, string(message))
+		}
+	}
+}
+
+var serviceCheckTests = []struct {
+	Namespace string
+	Name      string
+	Status    ServiceCheckStatus
+	Opts      *ServiceCheckOptions
+	Expected  string
+}{
+	{"", "check.name", Ok, nil, "_sc|check.name|0"},
+	{"", "check.name", Warn, nil, "_sc|check.name|1"},
+	{"", "check.name", Critical, &ServiceCheckOptions{Hostname: "hostname"}, "_sc|check.name|2|h:hostname"},
+	{"", "check.name", Unknown, &ServiceCheckOptions{Tags: []string{"tagA"}}, "_sc|check.name|3|#tagA"},
+	{"", "check.name", Critical, &ServiceCheckOptions{Message: "something broke"}, "_sc|check.name|2|m:something broke"},
+	{"flubber.", "check.name", Ok, nil, "_sc|flubber.check.name|0"},
+}
+
+func TestServiceCheck(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range serviceCheckTests {
+		client.Namespace = tt.Namespace
+		if err := client.ServiceCheck(tt.Name, tt.Status, tt.Opts); err != nil {
+			t.Fatal(err)
+		}
+
+		bytes := make([]byte, 1024)
+		n, err := server.Read(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := bytes[:n]
+		if string(message) != tt.Expected {
+			t.Errorf("Expected: %s. Actual: %s", tt.Expected, string(message))
+		}
+	}
+}
+
+func TestCapturingTransport(t *testing.T) {
+	transport := &CapturingTransport{}
+	client := NewWithTransport(transport)
+	client.Namespace = "foo."
+	client.Tags = []string{"dd:2"}
+
+	if err := client.Gauge("gg", 10, []string{"tagA"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Count("cc", 1, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transport.Payloads) != 2 {
+		t.Fatalf("Expected 2 captured payloads, got %d", len(transport.Payloads))
+	}
+	if string(transport.Payloads[0]) != "foo.gg:10.000000|g|#dd:2,tagA" {
+		t.Errorf("Got `%s`", transport.Payloads[0])
+	}
+	if string(transport.Payloads[1]) != "foo.cc:1|c|#dd:2" {
+		t.Errorf("Got `%s`", transport.Payloads[1])
+	}
+}
+
+func TestConcurrentSends(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewBuffered(addr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Give client.Tags spare capacity so a concurrent format() that wrote
+	// into it in place, rather than copying, would race and corrupt tags
+	// across goroutines under -race.
+	tags := make([]string, 1, 4)
+	tags[0] = "env:test"
+	client.Tags = tags
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				client.Count("concurrent.count", 1, []string{"worker:x"}, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	client, err := NewBuffered(addr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Gauge("background.gauge", 1, nil, 1)
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatalf("expected background flush to deliver the buffered metric, got: %s", err)
+	}
+	if string(buffer[:n]) != "background.gauge:1.000000|g" {
+		t.Errorf("Got `%s`", string(buffer[:n]))
+	}
+
+	assertNotPanics(t, func() { client.Close() })
+}
+
+func TestBackgroundFlushCustomInterval(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	client, err := NewBufferedWithInterval(addr, 100, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.FlushInterval != 20*time.Millisecond {
+		t.Fatalf("expected FlushInterval to be honored, got %s", client.FlushInterval)
+	}
+
+	client.Gauge("background.gauge", 1, nil, 1)
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatalf("expected background flush to deliver the buffered metric, got: %s", err)
+	}
+	if string(buffer[:n]) != "background.gauge:1.000000|g" {
+		t.Errorf("Got `%s`", string(buffer[:n]))
+	}
+}
+
+func TestClientSideAggregation(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		transport:             &udpTransport{conn: conn},
+		commands:              make([]string, 0, 10),
+		bufferLength:          10,
+		ClientSideAggregation: true,
+	}
+
+	client.Count("cc", 1, nil, 1)
+	client.Count("cc", 2, nil, 1)
+	client.Count("cc", 3, nil, 1)
+	client.Gauge("gg", 1, nil, 1)
+	client.Gauge("gg", 2, nil, 1)
+	client.Set("ss", "alice", nil, 1)
+	client.Set("ss", "bob", nil, 1)
+
+	if len(client.commands) != 2 {
+		t.Errorf("Expected Set to bypass aggregation and land both calls in the command buffer, got %d\n", len(client.commands))
+	}
+
+	if err := client.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, line := range strings.Split(string(buffer[:n]), "\n") {
+		got[line] = true
+	}
+	if !got["cc:6|c"] {
+		t.Errorf("Expected aggregated count cc:6|c, got: %v", got)
+	}
+	if !got["gg:2.000000|g"] {
+		t.Errorf("Expected aggregated gauge to keep the last value, got: %v", got)
+	}
+	if !got["ss:alice|s"] || !got["ss:bob|s"] {
+		t.Errorf("Expected both distinct Set members to be sent, not collapsed, got: %v", got)
+	}
+}
+
+func TestClientSideAggregationWindowFollowsFlushInterval(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	client, err := NewBufferedWithInterval(addr, 100, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.ClientSideAggregation = true
+
+	client.Count("cc", 1, nil, 1)
+	client.Count("cc", 2, nil, 1)
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatalf("expected the background flusher to send the aggregation window on FlushInterval, got: %s", err)
+	}
+	if string(buffer[:n]) != "cc:3|c" {
+		t.Errorf("Got `%s`", string(buffer[:n]))
+	}
+}
+
+func TestBufferedDistributionAndTiming(t *testing.T) {
+	addr := "localhost:1201"
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufferLength := 2
+	client := &Client{
+		transport:    &udpTransport{conn: conn},
+		commands:     make([]string, 0, bufferLength),
+		bufferLength: bufferLength,
+	}
+
+	client.Distribution("dd", 2.3, nil, 1)
+	client.Timing("tt", 123456789*time.Nanosecond, nil, 1)
+
+	if err := client.flush(); err != nil {
+		t.Errorf("Error sending: %s", err)
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`dd:2.300000|d`,
+		`tt:123.456789|ms`,
+	}
+
+	for i, res := range strings.Split(string(buffer[:n]), "\n") {
+		if res != expected[i] {
+			t.Errorf("Got `%s`, expected `%s`", res, expected[i])
+		}
+	}
+}
+
 func TestNilSafe(t *testing.T) {
 	var c *Client = nil
 	assertNotPanics(t, func() { c.Close() })
@@ -211,3 +716,35 @@ func BenchmarkFormatOld(b *testing.B) {
 		c.format_old("system.cpu.load", "0.1", nil, 0.9)
 	}
 }
+
+// These benchmarks show the packet volume win ClientSideAggregation buys
+// for a hot counter: the unaggregated path formats and buffers a command
+// per call, while the aggregated path only touches a map entry until flush.
+
+func BenchmarkCountUnaggregated(b *testing.B) {
+	b.StopTimer()
+	conn, err := net.Dial("udp", "localhost:1201")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{transport: &udpTransport{conn: conn}, bufferLength: 8, commands: make([]string, 0, 8)}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		c.Count("test.count", 1, []string{"tagA"}, 1)
+	}
+}
+
+func BenchmarkCountAggregated(b *testing.B) {
+	b.StopTimer()
+	conn, err := net.Dial("udp", "localhost:1201")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{transport: &udpTransport{conn: conn}, bufferLength: 8, commands: make([]string, 0, 8), ClientSideAggregation: true}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		c.Count("test.count", 1, []string{"tagA"}, 1)
+	}
+}